@@ -0,0 +1,47 @@
+package proxy
+
+import "time"
+
+// AuditEventType identifies the lifecycle stage an AuditEvent describes.
+type AuditEventType string
+
+const (
+	// AuditEventConnect is emitted as soon as a proxyConnection is
+	// created for a new client.
+	AuditEventConnect AuditEventType = "connect"
+	// AuditEventHandshakeSuccessful is emitted once the RakNet
+	// handshake completes, i.e. after NewIncomingConnection.
+	AuditEventHandshakeSuccessful AuditEventType = "handshake_successful"
+	// AuditEventDisconnect is emitted when a proxyConnection tears down.
+	AuditEventDisconnect AuditEventType = "disconnect"
+)
+
+// AuditEvent is a single structured entry in the per-connection audit log,
+// modeled on ContainerSSH's connect/disconnect audit payloads.
+type AuditEvent struct {
+	Type       AuditEventType `json:"type"`
+	RemoteAddr string         `json:"remoteAddr"`
+	Country    string         `json:"country"`
+	ServerAddr string         `json:"serverAddr"`
+	SessionID  string         `json:"sessionID"`
+	Timestamp  time.Time      `json:"timestamp"`
+
+	// BytesFromClient, BytesFromServer, PacketsFromClient and
+	// PacketsFromServer are only populated on AuditEventDisconnect.
+	BytesFromClient   uint64 `json:"bytesFromClient,omitempty"`
+	BytesFromServer   uint64 `json:"bytesFromServer,omitempty"`
+	PacketsFromClient uint64 `json:"packetsFromClient,omitempty"`
+	PacketsFromServer uint64 `json:"packetsFromServer,omitempty"`
+}
+
+// AuditSink receives AuditEvents as a proxyConnection's lifecycle
+// progresses. Implementations must be safe for concurrent use.
+type AuditSink interface {
+	WriteEvent(event AuditEvent) error
+}
+
+// noopAuditSink discards every event; it's the default when no sink is
+// configured.
+type noopAuditSink struct{}
+
+func (noopAuditSink) WriteEvent(event AuditEvent) error { return nil }
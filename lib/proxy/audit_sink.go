@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// jsonLinesSink writes one JSON-encoded AuditEvent per line to w, so
+// operators can pipe audit events to fluentd/loki without parsing logrus
+// text output.
+type jsonLinesSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewStdoutAuditSink returns an AuditSink that writes JSON lines to
+// stdout.
+func NewStdoutAuditSink() AuditSink {
+	return &jsonLinesSink{w: os.Stdout}
+}
+
+// NewFileAuditSink returns an AuditSink that appends JSON lines to the file
+// at path, creating it if necessary.
+func NewFileAuditSink(path string) (AuditSink, error) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("audit: opening %s: %w", path, err)
+	}
+	return &jsonLinesSink{w: f}, nil
+}
+
+func (s *jsonLinesSink) WriteEvent(event AuditEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return json.NewEncoder(s.w).Encode(event)
+}
@@ -0,0 +1,46 @@
+package proxy
+
+import "sync"
+
+// datagramBuffer is a single reusable buffer sized to hold one RakNet
+// datagram. Buffers are handed out via acquireBuffer/releaseBuffer instead
+// of being allocated per read, so once the pool is warm the datagram
+// buffers themselves are not allocated per proxied packet. The read loops
+// still heap-allocate a udpPayloadHandle for each datagram they queue.
+type datagramBuffer = [MaxUDPSize]byte
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		metricBufferPoolNews.Inc()
+		return new(datagramBuffer)
+	},
+}
+
+// acquireBuffer gets a datagramBuffer from the pool, allocating a new one
+// only if the pool is empty.
+func acquireBuffer() *datagramBuffer {
+	metricBufferPoolGets.Inc()
+	return bufferPool.Get().(*datagramBuffer)
+}
+
+// releaseBuffer returns buf to the pool once the payload it held has been
+// fully proxied and is no longer referenced.
+func releaseBuffer(buf *datagramBuffer) {
+	bufferPool.Put(buf)
+}
+
+// udpPayloadHandle pairs a pooled buffer with the length of the datagram
+// read into it, so the buffer can be returned to the pool once the
+// datagram has been written to its destination.
+type udpPayloadHandle struct {
+	buf *datagramBuffer
+	n   int
+}
+
+func (h *udpPayloadHandle) payload() UDPPayload {
+	return h.buf[0:h.n]
+}
+
+func (h *udpPayloadHandle) release() {
+	releaseBuffer(h.buf)
+}
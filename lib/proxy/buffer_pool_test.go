@@ -0,0 +1,54 @@
+package proxy
+
+import "testing"
+
+// BenchmarkAcquireReleaseBuffer exercises the steady-state path of the read
+// loop - acquiring a buffer, then returning it once a payload has been
+// proxied - and should report zero allocations per operation once the pool
+// has warmed up (run with -benchmem to see AllocsPerOp).
+func BenchmarkAcquireReleaseBuffer(b *testing.B) {
+	// Warm the pool so the benchmark measures steady-state reuse, not
+	// the pool's initial allocations.
+	warm := acquireBuffer()
+	releaseBuffer(warm)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := acquireBuffer()
+		buf[0] = byte(i)
+		releaseBuffer(buf)
+	}
+}
+
+// BenchmarkApplyTransformers exercises the real client->server datapath of
+// a proxied packet - acquiring a pooled buffer, running it through the full
+// transformer chain (address rewriting plus obfuscation), then releasing
+// the buffer - and reports allocations per operation. obfuscationTransformer
+// derives its session key from the client GUID once and caches it, so only
+// the first iteration pays for the HMAC derivation; the OpenConnectionRequest2
+// address rewrite still hex-encodes the payload for its trace log lines on
+// every call, so allocations per operation are not zero.
+// BenchmarkAcquireReleaseBuffer alone can't catch an
+// allocation introduced inside the transformer chain itself, since it
+// never calls applyTransformers.
+func BenchmarkApplyTransformers(b *testing.B) {
+	pConn := newTestProxyConnection()
+	pConn.transformers = []PayloadTransformer{
+		addressRewriteTransformer{},
+		newObfuscationTransformer([]byte("benchmark-preshared-secret")),
+	}
+	original := openConnectionRequest2Payload(0xdeadbeefcafebabe)
+
+	warm := acquireBuffer()
+	releaseBuffer(warm)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := acquireBuffer()
+		handle := &udpPayloadHandle{buf: buf, n: copy(buf[:], original)}
+		if _, err := pConn.applyTransformers(DirectionFromClient, handle.payload()); err != nil {
+			b.Fatalf("unexpected error applying transformers: %v", err)
+		}
+		handle.release()
+	}
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+
+	log "github.com/sirupsen/logrus"
+	netipv4 "golang.org/x/net/ipv4"
+	netipv6 "golang.org/x/net/ipv6"
+)
+
+// newClientListenPacketConns wraps clientListenConn with ipv4.PacketConn and
+// ipv6.PacketConn so that replies can be sent from the exact local address a
+// client's packet arrived on, instead of whichever address the kernel picks
+// when the proxy is bound to 0.0.0.0 (or multiple interfaces). It returns nil
+// conns where IP_PKTINFO/IPV6_PKTINFO isn't supported by the platform, so
+// callers can fall back to the default WriteMsgUDP path.
+func newClientListenPacketConns(clientListenConn *net.UDPConn) (v4 *netipv4.PacketConn, v6 *netipv6.PacketConn) {
+	v4conn := netipv4.NewPacketConn(clientListenConn)
+	if err := v4conn.SetControlMessage(netipv4.FlagDst|netipv4.FlagInterface, true); err == nil {
+		v4 = v4conn
+	} else {
+		log.Warnf("IP_PKTINFO not supported on this platform, client-facing replies will use the default source address: %v", err)
+	}
+
+	v6conn := netipv6.NewPacketConn(clientListenConn)
+	if err := v6conn.SetControlMessage(netipv6.FlagDst|netipv6.FlagInterface, true); err == nil {
+		v6 = v6conn
+	} else {
+		log.Warnf("IPV6_PKTINFO not supported on this platform, client-facing replies will use the default source address: %v", err)
+	}
+
+	return v4, v6
+}
+
+// recordClientControlMessage stores the destination address and interface
+// index a client's packet arrived on, as observed by the listener's ReadFrom
+// call, so that replies on proxyPayloadFromServer can be sent from the same
+// local address the client originally contacted.
+func (pConn *proxyConnection) recordClientControlMessage(dst net.IP, ifIndex int) {
+	pConn.clientDst = dst
+	pConn.clientIfIndex = ifIndex
+}
+
+// writeToClient sends payload to the client, preserving the original
+// destination address when preserveDstAddr is enabled and a control message
+// has been recorded for this connection. ok is false when either condition
+// doesn't hold, or no PacketConn is available for the recorded address, and
+// the caller should fall back to clientListenConn.WriteMsgUDP.
+func (pConn *proxyConnection) writeToClient(payload UDPPayload) (n int, err error, ok bool) {
+	if !pConn.preserveDstAddr || pConn.clientDst == nil {
+		return 0, nil, false
+	}
+
+	if dst4 := pConn.clientDst.To4(); dst4 != nil && pConn.clientListenConnV4 != nil {
+		cm := &netipv4.ControlMessage{Src: dst4, IfIndex: pConn.clientIfIndex}
+		n, err = pConn.clientListenConnV4.WriteTo(payload, cm, pConn.clientAddr)
+		return n, err, true
+	}
+
+	if pConn.clientListenConnV6 != nil {
+		cm := &netipv6.ControlMessage{Src: pConn.clientDst, IfIndex: pConn.clientIfIndex}
+		n, err = pConn.clientListenConnV6.WriteTo(payload, cm, pConn.clientAddr)
+		return n, err, true
+	}
+
+	return 0, nil, false
+}
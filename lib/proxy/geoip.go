@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+	log "github.com/sirupsen/logrus"
+)
+
+// unknownCountry is reported by GeoIPLookup implementations whenever a
+// lookup can't be completed, e.g. because no database is configured or the
+// address isn't found in it.
+const unknownCountry = "XX"
+
+// GeoIPLookup resolves an IP address to an ISO 3166-1 alpha-2 country
+// code for the per-connection audit log.
+type GeoIPLookup interface {
+	Country(ip net.IP) string
+}
+
+// noopGeoIPLookup is used when no MaxMind database is configured; it
+// always reports unknownCountry.
+type noopGeoIPLookup struct{}
+
+func (noopGeoIPLookup) Country(ip net.IP) string { return unknownCountry }
+
+// maxmindGeoIPLookup resolves countries from a MaxMind GeoLite2/GeoIP2
+// .mmdb database.
+type maxmindGeoIPLookup struct {
+	db *maxminddb.Reader
+}
+
+// NewGeoIPLookup opens the MaxMind database at path and returns a
+// GeoIPLookup backed by it. If path is empty, it returns a lookup that
+// always reports unknownCountry instead of erroring.
+func NewGeoIPLookup(path string) (GeoIPLookup, error) {
+	if path == "" {
+		return noopGeoIPLookup{}, nil
+	}
+	db, err := maxminddb.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("geoip: opening %s: %w", path, err)
+	}
+	return &maxmindGeoIPLookup{db: db}, nil
+}
+
+func (l *maxmindGeoIPLookup) Country(ip net.IP) string {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+	}
+	if err := l.db.Lookup(ip, &record); err != nil {
+		log.Debugf("geoip: lookup failed for %v: %v", ip, err)
+		return unknownCountry
+	}
+	if record.Country.ISOCode == "" {
+		return unknownCountry
+	}
+	return record.Country.ISOCode
+}
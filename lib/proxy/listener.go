@@ -0,0 +1,147 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	netipv4 "golang.org/x/net/ipv4"
+	netipv6 "golang.org/x/net/ipv6"
+)
+
+// Config bundles the per-proxy settings threaded into every proxyConnection
+// created for an incoming client.
+type Config struct {
+	ServerAddr                 *net.UDPAddr
+	ProxyProtocolMode          ProxyProtocolMode
+	ProxyProtocolDeliveryMode  ProxyProtocolDeliveryMode
+	ProxyProtocolAcceptor      bool
+	PreserveDstAddr            bool
+	ObfuscationPresharedSecret []byte
+	AuditSink                  AuditSink
+	GeoIP                      GeoIPLookup
+}
+
+// Proxy listens on a single client-facing UDP socket and fans incoming
+// datagrams out to a proxyConnection per source address, creating one the
+// first time a client is seen.
+type Proxy struct {
+	config Config
+
+	clientListenConn   *net.UDPConn
+	clientListenConnV4 *netipv4.PacketConn
+	clientListenConnV6 *netipv6.PacketConn
+
+	mu    sync.Mutex
+	conns map[string]*proxyConnection
+}
+
+// NewProxy wraps clientListenConn for dispatch to per-client
+// proxyConnections. When config.PreserveDstAddr is set, clientListenConn is
+// also wrapped with ipv4.PacketConn/ipv6.PacketConn so ListenAndServe can
+// recover the destination address and interface index of each datagram.
+func NewProxy(clientListenConn *net.UDPConn, config Config) *Proxy {
+	p := &Proxy{
+		config:           config,
+		clientListenConn: clientListenConn,
+		conns:            make(map[string]*proxyConnection),
+	}
+	if config.PreserveDstAddr {
+		p.clientListenConnV4, p.clientListenConnV6 = newClientListenPacketConns(clientListenConn)
+	}
+	return p
+}
+
+// ListenAndServe reads datagrams from the client-facing socket until it
+// errors, dispatching each to the proxyConnection for its source address.
+func (p *Proxy) ListenAndServe() error {
+	for {
+		buf := acquireBuffer()
+		n, clientAddr, dst, ifIndex, err := p.readFrom(buf[:])
+		if err != nil {
+			releaseBuffer(buf)
+			return err
+		}
+
+		pConn, err := p.connectionFor(clientAddr)
+		if err != nil {
+			log.Warnf("[%v] unable to open proxy connection: %v", clientAddr, err)
+			releaseBuffer(buf)
+			continue
+		}
+		if dst != nil {
+			pConn.recordClientControlMessage(dst, ifIndex)
+		}
+
+		handle := &udpPayloadHandle{buf: buf, n: n}
+		select {
+		case pConn.payloadsFromClientChan <- handle:
+			metricQueueDepthFromClient.Inc()
+		default:
+			pConn.logf(log.Warnf, "payload queue from client is full, dropping datagram of %d bytes", n)
+			metricQueueDropsFromClient.Inc()
+			handle.release()
+		}
+	}
+}
+
+// readFrom reads a single datagram into buf, returning the client address
+// it came from and, when the listener was wrapped for PreserveDstAddr, the
+// destination address and interface index it arrived on.
+func (p *Proxy) readFrom(buf []byte) (n int, clientAddr *net.UDPAddr, dst net.IP, ifIndex int, err error) {
+	if p.clientListenConnV4 != nil {
+		var cm *netipv4.ControlMessage
+		var src net.Addr
+		if n, cm, src, err = p.clientListenConnV4.ReadFrom(buf); err == nil {
+			if cm != nil {
+				dst, ifIndex = cm.Dst, cm.IfIndex
+			}
+			return n, src.(*net.UDPAddr), dst, ifIndex, nil
+		}
+	}
+
+	if p.clientListenConnV6 != nil {
+		var cm *netipv6.ControlMessage
+		var src net.Addr
+		if n, cm, src, err = p.clientListenConnV6.ReadFrom(buf); err == nil {
+			if cm != nil {
+				dst, ifIndex = cm.Dst, cm.IfIndex
+			}
+			return n, src.(*net.UDPAddr), dst, ifIndex, nil
+		}
+	}
+
+	n, clientAddr, err = p.clientListenConn.ReadFromUDP(buf)
+	return n, clientAddr, nil, 0, err
+}
+
+// connectionFor returns the proxyConnection handling clientAddr, creating
+// one via newProxyConnection the first time this client is seen.
+func (p *Proxy) connectionFor(clientAddr *net.UDPAddr) (*proxyConnection, error) {
+	key := clientAddr.String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if pConn, ok := p.conns[key]; ok {
+		return pConn, nil
+	}
+
+	pConn, err := newProxyConnection(
+		p.clientListenConn,
+		clientAddr,
+		p.config.ServerAddr,
+		p.config.ProxyProtocolMode,
+		p.config.ProxyProtocolDeliveryMode,
+		p.config.ProxyProtocolAcceptor,
+		p.config.PreserveDstAddr,
+		p.config.ObfuscationPresharedSecret,
+		p.config.AuditSink,
+		p.config.GeoIP,
+	)
+	if err != nil {
+		return nil, err
+	}
+	p.conns[key] = pConn
+	return pConn, nil
+}
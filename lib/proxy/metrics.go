@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	metricBytesFromClient = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_bytes_from_client_total",
+		Help: "Total bytes proxied from clients to the upstream server.",
+	})
+	metricBytesFromServer = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_bytes_from_server_total",
+		Help: "Total bytes proxied from the upstream server to clients.",
+	})
+	metricPacketsFromClient = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_packets_from_client_total",
+		Help: "Total packets proxied from clients to the upstream server.",
+	})
+	metricPacketsFromServer = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_packets_from_server_total",
+		Help: "Total packets proxied from the upstream server to clients.",
+	})
+
+	metricQueueDepthFromClient = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "racknet_proxy_queue_depth_from_client",
+		Help: "Datagrams from clients buffered across all connections, waiting to be proxied.",
+	})
+	metricQueueDepthFromServer = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "racknet_proxy_queue_depth_from_server",
+		Help: "Datagrams from the upstream server buffered across all connections, waiting to be proxied.",
+	})
+
+	metricQueueDropsFromClient = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_queue_drops_from_client_total",
+		Help: "Datagrams from clients dropped because a connection's proxy queue was full.",
+	})
+	metricQueueDropsFromServer = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_queue_drops_from_server_total",
+		Help: "Datagrams from the upstream server dropped because a connection's proxy queue was full.",
+	})
+
+	metricBufferPoolGets = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_buffer_pool_gets_total",
+		Help: "Total datagram buffers acquired from the pool.",
+	})
+	metricBufferPoolNews = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "racknet_proxy_buffer_pool_news_total",
+		Help: "Total datagram buffers allocated fresh because the pool was empty (a subset of gets).",
+	})
+)
+
+// ServeMetrics starts a Prometheus /metrics HTTP endpoint on addr and
+// blocks until it fails. Callers should run it in its own goroutine; addr
+// is typically a loopback-only admin address, separate from the proxy's
+// client- and server-facing sockets.
+func ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("serving metrics on %s", addr)
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync/atomic"
+)
+
+// openConnectionRequest2MinLen is the byte offset at which an
+// OpenConnectionRequest2 payload's plaintext header (packet ID, magic,
+// server address, MTU and client GUID) ends.
+//
+// Magic(16) + ip version(1) + ipv4 addr+port(6) + MTU(2) + GUID(8), plus the
+// leading packet ID byte.
+const openConnectionRequest2MinLen = 1 + 16 + 1 + 6 + 2 + 8
+
+// newIncomingConnectionMinLen is the byte offset through NewIncomingConnection's
+// server address field - packet ID(1) + ip version(1) + ipv4 addr+port(6).
+const newIncomingConnectionMinLen = 1 + 1 + 6
+
+// openConnectionReply2MinLen is the byte offset through OpenConnectionReply2's
+// client address field - packet ID(1) + magic(16) + server GUID(8) +
+// ip version(1) + ipv4 addr+port(6).
+const openConnectionReply2MinLen = 1 + 16 + 8 + 1 + 6
+
+// connectionRequestAcceptedMinLen is the byte offset through
+// ConnectionRequestAccepted's client address field - packet ID(1) + ip
+// version(1) + ipv4 addr+port(6).
+const connectionRequestAcceptedMinLen = 1 + 1 + 6
+
+// obfuscationTransformer XORs the body of a RakNet datagram (leaving
+// payload[0], the packet ID, intact so RakNet framing still validates on
+// the wire) with a keystream derived from a per-session key. It's inspired
+// by obfs4/Cloak-style scramblers: the goal isn't strong cryptographic
+// secrecy, just enough to defeat naive RakNet-protocol fingerprinting.
+//
+// The session key is derived from the client GUID carried in the
+// OpenConnectionRequest2 handshake packet plus a shared pre-shared secret
+// from config. Both ends need that GUID to derive the key, but it lives
+// inside the very packet that would otherwise be obfuscated - so
+// OpenConnectionRequest2's header (through the GUID, byte
+// openConnectionRequest2MinLen) is always left in plaintext as a bootstrap
+// window, and only the remainder of that packet, plus every later packet's
+// body, is XORed. A matching obfuscationTransformer on the other side of
+// the link reads the same plaintext GUID, derives the same key, and XOR
+// being its own inverse, decrypts inbound traffic.
+//
+// The other three RakNet handshake packets (NewIncomingConnection,
+// OpenConnectionReply2, ConnectionRequestAccepted) also carry address
+// fields that addressRewriteTransformer needs to read and patch in place.
+// Rather than pick an order between the two transformers - which breaks
+// down as soon as the same proxyConnection's DirectionFromClient chain is
+// used both to encode traffic bound for a matching obfuscationTransformer
+// downstream and to decode traffic received from one upstream, as it is in
+// a chained deployment - plaintextWindowLen carves out the same kind of
+// bootstrap window for each of them, so their address fields are always
+// left plaintext and the two transformers' byte ranges never overlap.
+// That makes the order they run in irrelevant to correctness.
+type obfuscationTransformer struct {
+	presharedSecret []byte
+
+	// cachedKey holds the []byte session key once sessionKey has derived
+	// it from the client GUID, so repeated calls don't re-run HMAC-SHA256
+	// and re-allocate on every packet. It's set at most once in practice
+	// (the GUID a session derives its key from never changes), but is
+	// read and written from both the client- and server-handling
+	// goroutines, so it's an atomic.Value rather than a plain field.
+	cachedKey atomic.Value
+}
+
+// plaintextWindowLen returns the number of leading bytes of a RakNet
+// handshake payload (including the packet ID byte) that must stay
+// plaintext for addressRewriteTransformer to parse and patch its address
+// fields, or 1 (just the packet ID, to preserve RakNet framing) for any
+// other packet.
+func plaintextWindowLen(payload UDPPayload) int {
+	if len(payload) < 1 {
+		return 1
+	}
+	switch payload[0] {
+	case packetOpenConnectionRequest2:
+		return openConnectionRequest2MinLen
+	case packetNewIncomingConnection:
+		return newIncomingConnectionMinLen
+	case packetOpenConnectionReply2:
+		return openConnectionReply2MinLen
+	case packetConnectionRequestAccepted:
+		return connectionRequestAcceptedMinLen
+	default:
+		return 1
+	}
+}
+
+// newObfuscationTransformer builds an obfuscationTransformer keyed off
+// presharedSecret. Both ends of an obfuscated link must be configured with
+// the same secret.
+func newObfuscationTransformer(presharedSecret []byte) *obfuscationTransformer {
+	return &obfuscationTransformer{presharedSecret: presharedSecret}
+}
+
+func (t *obfuscationTransformer) Transform(direction Direction, payload UDPPayload, ctx *TransformContext) (UDPPayload, error) {
+	if len(payload) < 1 {
+		return payload, nil
+	}
+
+	if direction == DirectionFromClient && payload[0] == packetOpenConnectionRequest2 {
+		ctx.pConn.recordClientGUID(payload)
+	}
+
+	obfuscateFrom := 1
+	if win := plaintextWindowLen(payload); len(payload) >= win {
+		obfuscateFrom = win
+	}
+
+	key := t.sessionKey(ctx.pConn)
+	if key == nil {
+		// No GUID observed yet (e.g. a packet arrived before
+		// OpenConnectionRequest2, or the session is IPv6, which this
+		// proxy doesn't track addresses for) - pass through
+		// unmodified rather than guessing at a key.
+		return payload, nil
+	}
+
+	xorKeystream(payload[obfuscateFrom:], key)
+	return payload, nil
+}
+
+// recordClientGUID extracts the client GUID from an OpenConnectionRequest2
+// payload, if payload is one, and stores it on pConn for session key
+// derivation. It's called before the packet is obfuscated, so the GUID
+// bytes are still plaintext. clientGUID is written here from the
+// client-handling goroutine and read from the server-handling goroutine in
+// sessionKey, so it's touched atomically.
+func (pConn *proxyConnection) recordClientGUID(payload UDPPayload) {
+	if payload[0] != packetOpenConnectionRequest2 || len(payload) < openConnectionRequest2MinLen {
+		return
+	}
+	if payload[17] != ipv4 {
+		return
+	}
+	atomic.StoreUint64(&pConn.clientGUID, binary.BigEndian.Uint64(payload[26:34]))
+}
+
+// sessionKey derives a per-session obfuscation key from pConn's client GUID
+// and the transformer's pre-shared secret, caching the result in cachedKey
+// so the HMAC derivation only runs once per connection rather than once per
+// packet. It returns nil until a client GUID has been observed.
+func (t *obfuscationTransformer) sessionKey(pConn *proxyConnection) []byte {
+	if cached := t.cachedKey.Load(); cached != nil {
+		return cached.([]byte)
+	}
+
+	guid := atomic.LoadUint64(&pConn.clientGUID)
+	if guid == 0 {
+		return nil
+	}
+	guidBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(guidBytes, guid)
+
+	mac := hmac.New(sha256.New, t.presharedSecret)
+	mac.Write(guidBytes)
+	key := mac.Sum(nil)
+	t.cachedKey.Store(key)
+	return key
+}
+
+// xorKeystream XORs data in place with key, repeating key as needed.
+func xorKeystream(data, key []byte) {
+	for i := range data {
+		data[i] ^= key[i%len(key)]
+	}
+}
@@ -0,0 +1,245 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+// openConnectionRequest2Payload builds a synthetic OpenConnectionRequest2
+// packet, as captured from a real RakNet handshake, carrying the given
+// client GUID and padded out to a realistic MTU-probe size.
+func openConnectionRequest2Payload(guid uint64) []byte {
+	const paddingLen = 20
+	payload := make([]byte, openConnectionRequest2MinLen+paddingLen)
+	payload[0] = packetOpenConnectionRequest2
+	// payload[1:17] magic - contents don't matter for this test.
+	payload[17] = ipv4
+	copy(payload[18:22], net.IPv4(127, 0, 0, 1).To4())
+	binary.BigEndian.PutUint16(payload[22:24], 19132)
+	// payload[24:26] MTU - contents don't matter for this test.
+	binary.BigEndian.PutUint64(payload[26:34], guid)
+	for i := openConnectionRequest2MinLen; i < len(payload); i++ {
+		payload[i] = 0xAB // MTU padding, as a real client would send
+	}
+	return payload
+}
+
+// newIncomingConnectionPayload builds a synthetic NewIncomingConnection
+// packet carrying serverAddr as its rewritten server address field, padded
+// with trailing bytes a real client's internal-address fields would occupy.
+func newIncomingConnectionPayload(serverAddr *net.UDPAddr) []byte {
+	const trailerLen = 16
+	payload := make([]byte, newIncomingConnectionMinLen+trailerLen)
+	payload[0] = packetNewIncomingConnection
+	payload[1] = ipv4
+	copy(payload[2:6], serverAddr.IP.To4())
+	binary.BigEndian.PutUint16(payload[6:8], uint16(serverAddr.Port))
+	for i := newIncomingConnectionMinLen; i < len(payload); i++ {
+		payload[i] = 0xCD
+	}
+	return payload
+}
+
+func newTestProxyConnection() *proxyConnection {
+	pConn := &proxyConnection{
+		clientAddr:      &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 12345},
+		serverAddr:      &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 19132},
+		clientAddrBytes: make([]byte, 6),
+		serverAddrBytes: make([]byte, 6),
+	}
+	pConn.transformCtx = TransformContext{pConn: pConn}
+	return pConn
+}
+
+// TestObfuscationTransformerRoundTrip simulates the real deployment this
+// transformer targets: an encoding proxy and a decoding proxy are two
+// independent proxyConnections (e.g. on opposite ends of an obfuscated
+// link) that have never shared state directly. The only thing that lets
+// the decoding side derive the same session key is the plaintext
+// OpenConnectionRequest2 header/GUID bootstrap window.
+func TestObfuscationTransformerRoundTrip(t *testing.T) {
+	secret := []byte("test-preshared-secret")
+	original := openConnectionRequest2Payload(0xdeadbeefcafebabe)
+
+	encodePConn := newTestProxyConnection()
+	encodePConn.transformers = []PayloadTransformer{newObfuscationTransformer(secret)}
+	encoded := append(UDPPayload{}, original...)
+	encoded, err := encodePConn.applyTransformers(DirectionFromClient, encoded)
+	if err != nil {
+		t.Fatalf("unexpected error obfuscating payload: %v", err)
+	}
+	if !bytes.Equal(encoded[:openConnectionRequest2MinLen], original[:openConnectionRequest2MinLen]) {
+		t.Fatalf("expected OpenConnectionRequest2 header/GUID to stay plaintext for bootstrap")
+	}
+	if bytes.Equal(encoded[openConnectionRequest2MinLen:], original[openConnectionRequest2MinLen:]) {
+		t.Fatalf("expected payload body past the bootstrap window to be obfuscated")
+	}
+	if len(encoded) > MaxUDPSize {
+		t.Fatalf("obfuscated payload exceeds MaxUDPSize: %d > %d", len(encoded), MaxUDPSize)
+	}
+
+	// The decoding side is a brand new proxyConnection that has only
+	// ever seen the encoded bytes - it must recover the GUID from the
+	// still-plaintext header, exactly as the encoding side did.
+	decodePConn := newTestProxyConnection()
+	decodePConn.transformers = []PayloadTransformer{newObfuscationTransformer(secret)}
+	decoded, err := decodePConn.applyTransformers(DirectionFromClient, encoded)
+	if err != nil {
+		t.Fatalf("unexpected error decoding payload: %v", err)
+	}
+	if !bytes.Equal(decoded, original) {
+		t.Fatalf("round-tripped payload does not match original:\ngot:  %x\nwant: %x", decoded, original)
+	}
+}
+
+func TestFullTransformerChainPreservesSize(t *testing.T) {
+	secret := []byte("test-preshared-secret")
+	original := openConnectionRequest2Payload(0x1122334455667788)
+
+	pConn := newTestProxyConnection()
+	pConn.transformers = []PayloadTransformer{
+		addressRewriteTransformer{},
+		newObfuscationTransformer(secret),
+	}
+
+	payload := append(UDPPayload{}, original...)
+	transformed, err := pConn.applyTransformers(DirectionFromClient, payload)
+	if err != nil {
+		t.Fatalf("unexpected error running transformer chain: %v", err)
+	}
+	if len(transformed) != len(original) {
+		t.Fatalf("transformer chain changed payload length: got %d want %d", len(transformed), len(original))
+	}
+	if len(transformed) > MaxUDPSize {
+		t.Fatalf("transformed payload exceeds MaxUDPSize: %d > %d", len(transformed), MaxUDPSize)
+	}
+}
+
+// invertedAddrBytes replicates the RakNet address encoding newProxyConnection
+// computes for clientAddrBytes/serverAddrBytes: each IP byte bitwise
+// inverted, followed by the big-endian port.
+func invertedAddrBytes(addr *net.UDPAddr) []byte {
+	portBytes := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBytes, uint16(addr.Port))
+	ipBytes := make([]byte, 4)
+	for i, b := range addr.IP.To4() {
+		ipBytes[i] = ^b
+	}
+	return append(ipBytes, portBytes...)
+}
+
+// newRealProxyConnection builds a proxyConnection wired to real UDP sockets,
+// with the address-rewrite and obfuscation transformers configured exactly
+// as newProxyConnection would, but without spawning its run() goroutine -
+// so tests can drive proxyPayloadFromClient/proxyPayloadFromServer directly
+// and deterministically.
+func newRealProxyConnection(serverConn *net.UDPConn, clientAddr, serverAddr *net.UDPAddr, secret []byte) *proxyConnection {
+	pConn := &proxyConnection{
+		serverConn:      serverConn,
+		clientAddr:      clientAddr,
+		serverAddr:      serverAddr,
+		clientAddrBytes: invertedAddrBytes(clientAddr),
+		serverAddrBytes: invertedAddrBytes(serverAddr),
+		auditSink:       noopAuditSink{},
+		geoip:           noopGeoIPLookup{},
+	}
+	pConn.transformCtx = TransformContext{pConn: pConn}
+	pConn.transformers = []PayloadTransformer{addressRewriteTransformer{}, newObfuscationTransformer(secret)}
+	return pConn
+}
+
+// readUDPPayload reads a single datagram from conn, failing the test if none
+// arrives within a couple of seconds.
+func readUDPPayload(t *testing.T, conn *net.UDPConn) []byte {
+	t.Helper()
+	buf := make([]byte, MaxUDPSize)
+	if err := conn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+		t.Fatalf("unable to set read deadline: %v", err)
+	}
+	n, _, err := conn.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatalf("unable to read UDP payload: %v", err)
+	}
+	return buf[:n]
+}
+
+// TestObfuscatedChainRewritesAddressAtEachHop reproduces a chained
+// deployment - an edge proxyConnection (p1) forwarding obfuscated traffic to
+// a second proxyConnection (p2) that talks to the real backend - through the
+// real proxyPayloadFromClient entry point at each hop, not applyTransformers
+// called by hand. Before plaintextWindowLen confined address-rewriting to a
+// bootstrap window, p2's addressRewriteTransformer read p1's ciphertext,
+// failed its ipVersion check, and silently skipped the rewrite, leaving p1's
+// address in the packet instead of p2's own serverAddrBytes.
+func TestObfuscatedChainRewritesAddressAtEachHop(t *testing.T) {
+	secret := []byte("test-preshared-secret")
+
+	backendConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen for fake backend: %v", err)
+	}
+	defer backendConn.Close()
+
+	p2ListenConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("unable to listen for p2: %v", err)
+	}
+	defer p2ListenConn.Close()
+
+	p2ServerConn, err := net.DialUDP("udp", nil, backendConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unable to dial fake backend from p2: %v", err)
+	}
+	defer p2ServerConn.Close()
+	p2 := newRealProxyConnection(p2ServerConn, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 40000}, backendConn.LocalAddr().(*net.UDPAddr), secret)
+
+	p1ServerConn, err := net.DialUDP("udp", nil, p2ListenConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatalf("unable to dial p2 from p1: %v", err)
+	}
+	defer p1ServerConn.Close()
+	p1 := newRealProxyConnection(p1ServerConn, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 50000}, p2ListenConn.LocalAddr().(*net.UDPAddr), secret)
+
+	// Bootstrap the obfuscation session key on both hops from an
+	// OpenConnectionRequest2 packet, exactly as a real handshake would.
+	guid := uint64(0xfeedfacecafebeef)
+	if _, err := p1.proxyPayloadFromClient(openConnectionRequest2Payload(guid)); err != nil {
+		t.Fatalf("p1: unexpected error proxying OpenConnectionRequest2: %v", err)
+	}
+	if _, err := p2.proxyPayloadFromClient(readUDPPayload(t, p2ListenConn)); err != nil {
+		t.Fatalf("p2: unexpected error proxying OpenConnectionRequest2: %v", err)
+	}
+	readUDPPayload(t, backendConn) // drain; not asserted on
+
+	// Send a NewIncomingConnection packet through the same chain.
+	original := newIncomingConnectionPayload(p1.serverAddr)
+	if _, err := p1.proxyPayloadFromClient(append(UDPPayload(nil), original...)); err != nil {
+		t.Fatalf("p1: unexpected error proxying NewIncomingConnection: %v", err)
+	}
+
+	atP2 := readUDPPayload(t, p2ListenConn)
+	if bytes.Equal(atP2[newIncomingConnectionMinLen:], original[newIncomingConnectionMinLen:]) {
+		t.Fatalf("expected NewIncomingConnection body past the address window to be obfuscated in transit between p1 and p2")
+	}
+
+	if _, err := p2.proxyPayloadFromClient(atP2); err != nil {
+		t.Fatalf("p2: unexpected error proxying NewIncomingConnection: %v", err)
+	}
+	atBackend := readUDPPayload(t, backendConn)
+
+	if atBackend[0] != packetNewIncomingConnection {
+		t.Fatalf("packet ID corrupted: got %d want %d", atBackend[0], packetNewIncomingConnection)
+	}
+	if bytes.Equal(atBackend[2:8], p1.serverAddrBytes) {
+		t.Fatalf("packet delivered to the real backend still carries p1's rewritten address instead of p2's own")
+	}
+	if !bytes.Equal(atBackend[2:8], p2.serverAddrBytes) {
+		t.Fatalf("expected the packet delivered to the real backend to carry p2's own serverAddrBytes (%x), got %x", p2.serverAddrBytes, atBackend[2:8])
+	}
+	if !bytes.Equal(atBackend[newIncomingConnectionMinLen:], original[newIncomingConnectionMinLen:]) {
+		t.Fatalf("body past the address window was not correctly de-obfuscated by the time it reached the real backend:\ngot:  %x\nwant: %x", atBackend[newIncomingConnectionMinLen:], original[newIncomingConnectionMinLen:])
+	}
+}
@@ -0,0 +1,68 @@
+package proxy
+
+// Direction identifies which leg of the proxy a payload is travelling
+// through a PayloadTransformer chain.
+type Direction int
+
+const (
+	// DirectionFromClient is a payload travelling client -> server.
+	DirectionFromClient Direction = iota
+	// DirectionFromServer is a payload travelling server -> client.
+	DirectionFromServer
+)
+
+// TransformContext carries the per-connection state a PayloadTransformer
+// may need (e.g. the observed client/server addresses, or session state
+// accumulated across calls). Each proxyConnection owns exactly one
+// TransformContext, reused across every payload it proxies, so that
+// applyTransformers doesn't allocate one per packet.
+type TransformContext struct {
+	pConn *proxyConnection
+}
+
+// PayloadTransformer is a single stage in the ordered chain of
+// transformations applied to a RakNet datagram as it crosses the proxy. The
+// built-in address-rewriting transformer (addressRewriteTransformer) is
+// always first; additional transformers, such as obfuscationTransformer,
+// can be layered on top via proxyConnection.transformers.
+//
+// Later transformers must not disturb the bytes an earlier transformer
+// needs to read or write on a later call - e.g. obfuscationTransformer
+// leaves each RakNet handshake packet's address fields in plaintext
+// (see plaintextWindowLen) specifically so that addressRewriteTransformer
+// keeps working regardless of which side of the obfuscation boundary a
+// given proxyConnection sits on.
+type PayloadTransformer interface {
+	Transform(direction Direction, payload UDPPayload, ctx *TransformContext) (UDPPayload, error)
+}
+
+// addressRewriteTransformer is the built-in transformer that rewrites the
+// address fields embedded in RakNet's connection-establishment packets, as
+// previously done directly in updatePayloadFromClient/updatePayloadFromServer.
+type addressRewriteTransformer struct{}
+
+func (addressRewriteTransformer) Transform(direction Direction, payload UDPPayload, ctx *TransformContext) (UDPPayload, error) {
+	switch direction {
+	case DirectionFromClient:
+		return payload, ctx.pConn.updatePayloadFromClient(payload)
+	case DirectionFromServer:
+		return payload, ctx.pConn.updatePayloadFromServer(payload)
+	default:
+		return payload, nil
+	}
+}
+
+// applyTransformers runs payload through pConn's transformer chain in
+// order, stopping early if a transformer returns an error. It reuses
+// pConn.transformCtx rather than allocating a TransformContext per call,
+// since this runs once per proxied packet in each direction.
+func (pConn *proxyConnection) applyTransformers(direction Direction, payload UDPPayload) (UDPPayload, error) {
+	for _, transformer := range pConn.transformers {
+		var err error
+		payload, err = transformer.Transform(direction, payload, &pConn.transformCtx)
+		if err != nil {
+			return payload, err
+		}
+	}
+	return payload, nil
+}
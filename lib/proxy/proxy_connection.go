@@ -5,13 +5,43 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"sync/atomic"
+	"time"
 
 	log "github.com/sirupsen/logrus"
+	netipv4 "golang.org/x/net/ipv4"
+	netipv6 "golang.org/x/net/ipv6"
 )
 
+// sessionIDCounter generates unique, process-local session IDs for the
+// audit log.
+var sessionIDCounter uint64
+
+func nextSessionID(clientAddr *net.UDPAddr) string {
+	return fmt.Sprintf("%s-%d", clientAddr, atomic.AddUint64(&sessionIDCounter, 1))
+}
+
+// defaultQueueSize bounds how many not-yet-proxied datagrams a
+// proxyConnection will buffer, in each direction, before dropping new
+// ones. It trades a small amount of burst tolerance for bounded memory and
+// goroutine backpressure.
+const defaultQueueSize = 64
+
+// idleTimeout is how long a proxyConnection will wait without seeing
+// traffic in either direction before tearing itself down. It's what
+// actually lets run's read loop exit and the deferred
+// emitDisconnectEvent fire - a RakNet session that simply goes quiet
+// (client closes the game, crashes, loses its network) never sends
+// anything run() would otherwise treat as a close signal.
+const idleTimeout = 5 * time.Minute
+
+// idleCheckInterval is how often run's read loop wakes up to check
+// whether idleTimeout has elapsed, via serverConn's read deadline.
+const idleCheckInterval = 30 * time.Second
+
 type proxyConnection struct {
-	payloadsFromServerChan chan UDPPayload
-	payloadsFromClientChan chan UDPPayload
+	payloadsFromServerChan chan *udpPayloadHandle
+	payloadsFromClientChan chan *udpPayloadHandle
 
 	clientListenConn *net.UDPConn
 	serverConn       *net.UDPConn
@@ -21,11 +51,89 @@ type proxyConnection struct {
 
 	clientAddrBytes []byte
 	serverAddrBytes []byte
+
+	// proxyProtocolMode controls whether a PROXY protocol v2 header is
+	// sent once to the upstream server on session establishment.
+	proxyProtocolMode ProxyProtocolMode
+	// proxyProtocolDeliveryMode controls whether that header is sent as
+	// its own datagram or prepended to the first client-to-server
+	// payload. It's only consulted when proxyProtocolMode is
+	// ProxyProtocolV2; the zero value behaves as
+	// ProxyProtocolDeliveryOwnDatagram.
+	proxyProtocolDeliveryMode ProxyProtocolDeliveryMode
+	// pendingProxyProtocolV2Header is set when proxyProtocolDeliveryMode
+	// is ProxyProtocolDeliveryPrepend and the header hasn't yet been
+	// prepended to an outbound payload.
+	pendingProxyProtocolV2Header bool
+	// proxyProtocolAcceptor indicates this proxy is itself chained
+	// behind another PROXY-v2-emitting UDP frontend, and should strip an
+	// inbound v2 header from the first client payload instead of
+	// treating it as RakNet traffic.
+	proxyProtocolAcceptor          bool
+	strippedClientProxyProtocolHdr bool
+
+	// preserveDstAddr controls whether replies to the client are sent
+	// from the exact local address the client's packet arrived on,
+	// rather than whichever address the kernel picks.
+	preserveDstAddr    bool
+	clientListenConnV4 *netipv4.PacketConn
+	clientListenConnV6 *netipv6.PacketConn
+	clientDst          net.IP
+	clientIfIndex      int
+
+	// transformers is the ordered chain of PayloadTransformers applied to
+	// every payload crossing the proxy. addressRewriteTransformer is
+	// always first; an obfuscationTransformer is appended when an
+	// obfuscation pre-shared secret is configured.
+	transformers []PayloadTransformer
+	// transformCtx is reused across every call to applyTransformers,
+	// rather than allocated fresh per packet.
+	transformCtx TransformContext
+	// clientGUID is the RakNet client GUID observed in the client's
+	// OpenConnectionRequest2 packet, used to derive a per-session
+	// obfuscation key. It's written from the client-handling goroutine and
+	// read from the server-handling goroutine, so it must be touched
+	// atomically.
+	clientGUID uint64
+
+	// sessionID, auditSink and geoip back the per-connection audit log.
+	sessionID string
+	auditSink AuditSink
+	geoip     GeoIPLookup
+
+	// bytesFromClient, bytesFromServer, packetsFromClient and
+	// packetsFromServer accumulate the counters reported in the
+	// disconnect audit event. They're updated from both the client and
+	// server payload-handling goroutines, so must be touched atomically.
+	bytesFromClient   uint64
+	bytesFromServer   uint64
+	packetsFromClient uint64
+	packetsFromServer uint64
+
+	// lastActivityUnixNano is the time.UnixNano of the last payload
+	// proxied in either direction, used by run's read loop to detect an
+	// idle connection worth tearing down. It's written from both the
+	// client- and server-handling goroutines, so it must be touched
+	// atomically.
+	lastActivityUnixNano int64
 }
 
-func newProxyConnection(clientListenConn *net.UDPConn, clientAddr *net.UDPAddr, serverAddr *net.UDPAddr) (*proxyConnection, error) {
+// touchActivity records that a payload was just proxied, resetting the
+// idle clock run's read loop checks against.
+func (pConn *proxyConnection) touchActivity() {
+	atomic.StoreInt64(&pConn.lastActivityUnixNano, time.Now().UnixNano())
+}
+
+func newProxyConnection(clientListenConn *net.UDPConn, clientAddr *net.UDPAddr, serverAddr *net.UDPAddr, proxyProtocolMode ProxyProtocolMode, proxyProtocolDeliveryMode ProxyProtocolDeliveryMode, proxyProtocolAcceptor bool, preserveDstAddr bool, obfuscationPresharedSecret []byte, auditSink AuditSink, geoip GeoIPLookup) (*proxyConnection, error) {
 	log.Debugf("starting proxy connection for client %v...", clientAddr)
 
+	if auditSink == nil {
+		auditSink = noopAuditSink{}
+	}
+	if geoip == nil {
+		geoip = noopGeoIPLookup{}
+	}
+
 	clientPortBytes := make([]byte, 2)
 	binary.BigEndian.PutUint16(clientPortBytes, uint16(clientAddr.Port))
 	clientAddrBytes := make([]byte, 4)
@@ -43,21 +151,56 @@ func newProxyConnection(clientListenConn *net.UDPConn, clientAddr *net.UDPAddr,
 	serverAddrBytes = append(serverAddrBytes, serverPortBytes...)
 
 	pConn := &proxyConnection{
-		payloadsFromServerChan: make(chan UDPPayload, 1),
-		payloadsFromClientChan: make(chan UDPPayload, 1),
-		clientListenConn:       clientListenConn,
-		clientAddr:             clientAddr,
-		serverAddr:             serverAddr,
-		clientAddrBytes:        clientAddrBytes,
-		serverAddrBytes:        serverAddrBytes,
+		payloadsFromServerChan:    make(chan *udpPayloadHandle, defaultQueueSize),
+		payloadsFromClientChan:    make(chan *udpPayloadHandle, defaultQueueSize),
+		clientListenConn:          clientListenConn,
+		clientAddr:                clientAddr,
+		serverAddr:                serverAddr,
+		clientAddrBytes:           clientAddrBytes,
+		serverAddrBytes:           serverAddrBytes,
+		proxyProtocolMode:         proxyProtocolMode,
+		proxyProtocolDeliveryMode: proxyProtocolDeliveryMode,
+		proxyProtocolAcceptor:     proxyProtocolAcceptor,
+		preserveDstAddr:           preserveDstAddr,
+		sessionID:                 nextSessionID(clientAddr),
+		auditSink:                 auditSink,
+		geoip:                     geoip,
 	}
 
+	pConn.transformCtx = TransformContext{pConn: pConn}
+	pConn.transformers = []PayloadTransformer{addressRewriteTransformer{}}
+	if len(obfuscationPresharedSecret) > 0 {
+		pConn.transformers = append(pConn.transformers, newObfuscationTransformer(obfuscationPresharedSecret))
+	}
+
+	if preserveDstAddr {
+		pConn.clientListenConnV4, pConn.clientListenConnV6 = newClientListenPacketConns(clientListenConn)
+	}
+
+	pConn.emitAuditEvent(AuditEventConnect, AuditEvent{})
+
 	pConn.log(log.Debug, `connecting to server...`)
 	go pConn.run()
 
 	return pConn, nil
 }
 
+// emitAuditEvent fills in the fields common to every AuditEvent (type,
+// addresses, country, session ID and timestamp) and writes it to
+// pConn.auditSink, logging a warning if the sink fails.
+func (pConn *proxyConnection) emitAuditEvent(eventType AuditEventType, event AuditEvent) {
+	event.Type = eventType
+	event.RemoteAddr = pConn.clientAddr.String()
+	event.Country = pConn.geoip.Country(pConn.clientAddr.IP)
+	event.ServerAddr = pConn.serverAddr.String()
+	event.SessionID = pConn.sessionID
+	event.Timestamp = time.Now()
+
+	if err := pConn.auditSink.WriteEvent(event); err != nil {
+		pConn.logf(log.Warnf, "failed to write %s audit event: %v", eventType, err)
+	}
+}
+
 func (pConn *proxyConnection) logf(fn func(string, ...interface{}), msg string, args ...interface{}) {
 	msg = fmt.Sprintf("[%v] %s", pConn.clientAddr, msg)
 	fn(msg, args...)
@@ -76,8 +219,18 @@ func (pConn *proxyConnection) run() {
 		pConn.logf(log.Fatalf, "unable to dial upstream server UDP: %v", err)
 	}
 	defer serverConn.Close()
+	defer pConn.emitDisconnectEvent()
 	pConn.logf(log.Tracef, "got connection to server %v->%v", serverConn.LocalAddr(), serverConn.RemoteAddr())
 	pConn.serverConn = serverConn
+	pConn.touchActivity()
+
+	if pConn.proxyProtocolMode == ProxyProtocolV2 {
+		if pConn.proxyProtocolDeliveryMode == ProxyProtocolDeliveryPrepend {
+			pConn.pendingProxyProtocolV2Header = true
+		} else {
+			pConn.sendProxyProtocolV2Header()
+		}
+	}
 
 	pConn.log(log.Debug, `starting client payload listener...`)
 	go pConn.handlePayloadsFromClient()
@@ -85,48 +238,155 @@ func (pConn *proxyConnection) run() {
 	pConn.log(log.Debug, `starting server payload listener...`)
 	go pConn.handlePayloadsFromServer()
 
-	b := make([]byte, MaxUDPSize)
 	for {
-		n, _, err := serverConn.ReadFromUDP(b)
+		if err := serverConn.SetReadDeadline(time.Now().Add(idleCheckInterval)); err != nil {
+			pConn.logf(log.Warnf, "unable to set read deadline, disabling idle timeout: %v", err)
+		}
+
+		buf := acquireBuffer()
+		n, _, err := serverConn.ReadFromUDP(buf[:])
 		if err != nil {
+			releaseBuffer(buf)
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				if idleSince := time.Since(time.Unix(0, atomic.LoadInt64(&pConn.lastActivityUnixNano))); idleSince >= idleTimeout {
+					pConn.logf(log.Debugf, "closing idle connection after %v of inactivity", idleSince)
+					return
+				}
+				continue
+			}
 			pConn.logf(log.Debugf, "error reading %v->%v: %v", serverConn.RemoteAddr(), serverConn.LocalAddr(), err)
 			continue
 		}
-		payload := b[0:n]
-		pConn.logf(log.Tracef, `read %v->%v: (%d)"%s"`, serverConn.RemoteAddr(), serverConn.LocalAddr(), n, hex.EncodeToString(payload))
-		pConn.logf(log.Tracef, `writing payload from server to chan <- "%s"`, hex.EncodeToString(payload))
-		pConn.payloadsFromServerChan <- payload
+		pConn.touchActivity()
+		handle := &udpPayloadHandle{buf: buf, n: n}
+		pConn.logf(log.Tracef, `read %v->%v: (%d)"%s"`, serverConn.RemoteAddr(), serverConn.LocalAddr(), n, hex.EncodeToString(handle.payload()))
+
+		select {
+		case pConn.payloadsFromServerChan <- handle:
+			metricQueueDepthFromServer.Inc()
+		default:
+			pConn.logf(log.Warnf, "payload queue from server is full, dropping datagram of %d bytes", n)
+			metricQueueDropsFromServer.Inc()
+			handle.release()
+		}
 	}
 }
 
 func (pConn *proxyConnection) handlePayloadsFromClient() {
 	pConn.log(log.Debug, "listening for payloads from client...")
 
-	for payload := range pConn.payloadsFromClientChan {
+	for handle := range pConn.payloadsFromClientChan {
+		metricQueueDepthFromClient.Dec()
+		payload := handle.payload()
 		pConn.logf(log.Tracef, `proxying payload from client: "%s"`, hex.EncodeToString(payload))
+		pConn.touchActivity()
 		pConn.proxyPayloadFromClient(payload)
+		handle.release()
 	}
 }
 
 func (pConn *proxyConnection) handlePayloadsFromServer() {
 	pConn.log(log.Debug, "listening for payloads from server...")
 
-	for payload := range pConn.payloadsFromServerChan {
+	for handle := range pConn.payloadsFromServerChan {
+		metricQueueDepthFromServer.Dec()
+		payload := handle.payload()
 		pConn.logf(log.Tracef, `proxying payload from server: "%s"`, hex.EncodeToString(payload))
 		pConn.proxyPayloadFromServer(payload)
+		handle.release()
+	}
+}
+
+// emitDisconnectEvent emits the AuditEventDisconnect event with the
+// byte/packet counters accumulated over the lifetime of the connection.
+func (pConn *proxyConnection) emitDisconnectEvent() {
+	pConn.emitAuditEvent(AuditEventDisconnect, AuditEvent{
+		BytesFromClient:   atomic.LoadUint64(&pConn.bytesFromClient),
+		BytesFromServer:   atomic.LoadUint64(&pConn.bytesFromServer),
+		PacketsFromClient: atomic.LoadUint64(&pConn.packetsFromClient),
+		PacketsFromServer: atomic.LoadUint64(&pConn.packetsFromServer),
+	})
+}
+
+// sendProxyProtocolV2Header sends a single PROXY protocol v2 datagram to
+// the upstream server describing the real client address, so backends can
+// see the client that's actually behind this proxy.
+func (pConn *proxyConnection) sendProxyProtocolV2Header() {
+	header, err := buildProxyProtocolV2Header(pConn.clientAddr, pConn.serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		pConn.logf(log.Warnf, "unable to build PROXY protocol v2 header: %v", err)
+		return
+	}
+	if _, err := pConn.serverConn.Write(header); err != nil {
+		pConn.logf(log.Warnf, "unable to send PROXY protocol v2 header to upstream: %v", err)
+		return
+	}
+	pConn.log(log.Debug, "sent PROXY protocol v2 header to upstream")
+}
+
+// prependProxyProtocolV2Header is the ProxyProtocolDeliveryPrepend
+// counterpart to sendProxyProtocolV2Header: instead of writing the header
+// as its own datagram, it's stitched onto the front of the first
+// client-to-server payload so the two travel to the upstream server in a
+// single UDP datagram. It clears pendingProxyProtocolV2Header so later
+// payloads are left alone.
+func (pConn *proxyConnection) prependProxyProtocolV2Header(payload UDPPayload) UDPPayload {
+	pConn.pendingProxyProtocolV2Header = false
+
+	header, err := buildProxyProtocolV2Header(pConn.clientAddr, pConn.serverConn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		pConn.logf(log.Warnf, "unable to build PROXY protocol v2 header: %v", err)
+		return payload
 	}
+	pConn.log(log.Debug, "prepending PROXY protocol v2 header to first client payload")
+	return append(header, payload...)
 }
 
 func (pConn *proxyConnection) proxyPayloadFromClient(payload UDPPayload) (int, error) {
-	_ = pConn.updatePayloadFromClient(payload)
+	if pConn.proxyProtocolAcceptor && !pConn.strippedClientProxyProtocolHdr {
+		pConn.strippedClientProxyProtocolHdr = true
+		rest, ok, err := stripProxyProtocolV2Header(payload)
+		if err != nil {
+			pConn.logf(log.Warnf, "failed to strip inbound PROXY protocol v2 header: %v", err)
+		} else if ok {
+			pConn.log(log.Debug, "stripped inbound PROXY protocol v2 header")
+			payload = rest
+		}
+	}
+	payload, err := pConn.applyTransformers(DirectionFromClient, payload)
+	if err != nil {
+		pConn.logf(log.Warnf, "error applying payload transformers from client: %v", err)
+	}
+	if pConn.pendingProxyProtocolV2Header {
+		payload = pConn.prependProxyProtocolV2Header(payload)
+	}
 	pConn.logf(log.Tracef, `write %v->%v: "%s"`, pConn.clientAddr, pConn.serverAddr, hex.EncodeToString(payload))
-	return pConn.serverConn.Write(payload)
+	n, err := pConn.serverConn.Write(payload)
+	atomic.AddUint64(&pConn.packetsFromClient, 1)
+	atomic.AddUint64(&pConn.bytesFromClient, uint64(n))
+	metricPacketsFromClient.Inc()
+	metricBytesFromClient.Add(float64(n))
+	return n, err
 }
 
 func (pConn *proxyConnection) proxyPayloadFromServer(payload UDPPayload) (int, error) {
-	_ = pConn.updatePayloadFromServer(payload)
+	payload, err := pConn.applyTransformers(DirectionFromServer, payload)
+	if err != nil {
+		pConn.logf(log.Warnf, "error applying payload transformers from server: %v", err)
+	}
 	pConn.logf(log.Tracef, `write %v->%v: "%s"`, pConn.serverAddr, pConn.clientAddr, hex.EncodeToString(payload))
-	n, _, err := pConn.clientListenConn.WriteMsgUDP(payload, []byte{}, pConn.clientAddr)
+
+	var n int
+	if wn, werr, ok := pConn.writeToClient(payload); ok {
+		n, err = wn, werr
+	} else {
+		n, _, err = pConn.clientListenConn.WriteMsgUDP(payload, []byte{}, pConn.clientAddr)
+	}
+
+	atomic.AddUint64(&pConn.packetsFromServer, 1)
+	atomic.AddUint64(&pConn.bytesFromServer, uint64(n))
+	metricPacketsFromServer.Inc()
+	metricBytesFromServer.Add(float64(n))
 	return n, err
 }
 
@@ -190,6 +450,7 @@ func (pConn *proxyConnection) updateNewIncomingConnection(payload UDPPayload) er
 		// Replace payload[2:8] with server ip and port
 		copy(payload[2:8], pConn.serverAddrBytes)
 	}
+	pConn.emitAuditEvent(AuditEventHandshakeSuccessful, AuditEvent{})
 	return nil
 }
 
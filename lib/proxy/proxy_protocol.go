@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// ProxyProtocolMode controls whether a proxyConnection emits a HAProxy PROXY
+// protocol v2 header to the upstream server alongside the proxied RakNet
+// traffic. Stripping an inbound header is controlled separately, by
+// Config.ProxyProtocolAcceptor, whatever the mode.
+type ProxyProtocolMode string
+
+const (
+	// ProxyProtocolNone emits no PROXY protocol header.
+	ProxyProtocolNone ProxyProtocolMode = "none"
+	// ProxyProtocolV2 emits a PROXY protocol v2 header.
+	ProxyProtocolV2 ProxyProtocolMode = "v2"
+)
+
+// ProxyProtocolDeliveryMode controls how a proxyConnection delivers its
+// outbound PROXY protocol v2 header to the upstream server, when
+// ProxyProtocolMode is ProxyProtocolV2.
+type ProxyProtocolDeliveryMode string
+
+const (
+	// ProxyProtocolDeliveryOwnDatagram sends the PROXY protocol v2 header
+	// as its own UDP datagram, once, before any RakNet traffic. This is
+	// the default, and is what most HAProxy-style PROXY v2 consumers
+	// expect.
+	ProxyProtocolDeliveryOwnDatagram ProxyProtocolDeliveryMode = "own-datagram"
+	// ProxyProtocolDeliveryPrepend prepends the PROXY protocol v2 header
+	// to the first client-to-server payload instead of sending it as a
+	// separate datagram, for upstreams that expect exactly one datagram
+	// per handshake attempt.
+	ProxyProtocolDeliveryPrepend ProxyProtocolDeliveryMode = "prepend"
+)
+
+// proxyProtocolV2Signature is the fixed 12-byte signature that opens every
+// PROXY protocol v2 header.
+var proxyProtocolV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const (
+	proxyProtocolVersionCommand = 0x21 // version 2, command PROXY
+	proxyProtocolFamilyUDPv4    = 0x12 // AF_INET, SOCK_DGRAM
+	proxyProtocolFamilyUDPv6    = 0x22 // AF_INET6, SOCK_DGRAM
+	proxyProtocolV2HeaderLen    = 16   // signature(12) + ver/cmd(1) + fam/proto(1) + addr len(2)
+)
+
+// buildProxyProtocolV2Header builds a HAProxy PROXY protocol v2 header
+// describing a UDP session from src to dst. It's meant to be sent exactly
+// once, at session establishment, so the upstream server can recover the
+// real client address; RakNet framing wouldn't tolerate it being prepended
+// to every packet.
+//
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt
+func buildProxyProtocolV2Header(src, dst *net.UDPAddr) ([]byte, error) {
+	srcIP4 := src.IP.To4()
+	dstIP4 := dst.IP.To4()
+
+	var buf bytes.Buffer
+	buf.Write(proxyProtocolV2Signature)
+	buf.WriteByte(proxyProtocolVersionCommand)
+
+	if srcIP4 != nil && dstIP4 != nil {
+		buf.WriteByte(proxyProtocolFamilyUDPv4)
+		binary.Write(&buf, binary.BigEndian, uint16(12))
+		buf.Write(srcIP4)
+		buf.Write(dstIP4)
+		binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+		binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+		return buf.Bytes(), nil
+	}
+
+	srcIP16 := src.IP.To16()
+	dstIP16 := dst.IP.To16()
+	if srcIP16 == nil || dstIP16 == nil {
+		return nil, fmt.Errorf("proxy protocol: unable to determine address family for %v -> %v", src, dst)
+	}
+	buf.WriteByte(proxyProtocolFamilyUDPv6)
+	binary.Write(&buf, binary.BigEndian, uint16(36))
+	buf.Write(srcIP16)
+	buf.Write(dstIP16)
+	binary.Write(&buf, binary.BigEndian, uint16(src.Port))
+	binary.Write(&buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes(), nil
+}
+
+// stripProxyProtocolV2Header checks whether payload begins with a PROXY
+// protocol v2 header and, if so, returns the payload with the header
+// removed. ok is false when no header is present, in which case payload
+// should be used unchanged. This lets the proxy be chained behind another
+// PROXY-v2-emitting UDP frontend, stripping its header before the usual
+// updateOpenConnectionRequest2 rewriting runs.
+func stripProxyProtocolV2Header(payload UDPPayload) (rest UDPPayload, ok bool, err error) {
+	if len(payload) < proxyProtocolV2HeaderLen || !bytes.Equal(payload[0:12], proxyProtocolV2Signature) {
+		return payload, false, nil
+	}
+	addrLen := binary.BigEndian.Uint16(payload[14:16])
+	end := proxyProtocolV2HeaderLen + int(addrLen)
+	if end > len(payload) {
+		return nil, false, fmt.Errorf("proxy protocol: truncated v2 header, want %d bytes, have %d", end, len(payload))
+	}
+	return payload[end:], true, nil
+}